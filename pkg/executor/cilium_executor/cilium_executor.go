@@ -0,0 +1,230 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ciliumexecutor implements strategies.ExecutorInterface on top of
+// github.com/cilium/ebpf instead of the cgo close_fd/raw syscall path. It
+// lets programs be loaded, run and cleaned up without linking against
+// libbpf, and reuses cilium/ebpf's structured verifier log instead of a
+// hand rolled parser.
+package ciliumexecutor
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+
+	fpb "buzzer/proto/ebpf_fuzzer_go_proto"
+	"buzzer/pkg/strategies/strategies"
+)
+
+// defaultLogSize is the initial size requested for the verifier log buffer.
+// It is doubled and retried when the verifier reports the log was
+// truncated, mirroring cilium/ebpf's own retry behavior for short logs.
+const defaultLogSize = 1 << 20
+
+// maxLogSize bounds how many times defaultLogSize is doubled before the
+// executor gives up on capturing a complete verifier log.
+const maxLogSize = 1 << 26
+
+// useCiliumExecutor selects this backend instead of the default cgo/raw
+// syscall executor. Both backends implement strategies.ExecutorInterface,
+// so the caller that constructs the executor just needs to branch on
+// SelectExecutor.
+var useCiliumExecutor = flag.Bool("executor_backend_cilium", false,
+	"use the cilium/ebpf-based executor backend instead of the default cgo one")
+
+// SelectExecutor returns a CiliumExecutor when --executor_backend_cilium is
+// set, or nil otherwise so the caller falls back to its default executor.
+// The process entry point that constructs the strategies.ExecutorInterface
+// passed to Fuzz is outside this package (and outside this tree); it needs
+// a small branch - "if e := SelectExecutor(); e != nil { return e }" before
+// falling back to the default cgo executor - to actually make
+// --executor_backend_cilium take effect.
+func SelectExecutor() strategies.ExecutorInterface {
+	if !*useCiliumExecutor {
+		return nil
+	}
+	return New()
+}
+
+// CiliumExecutor is a strategies.ExecutorInterface backend that loads and
+// runs programs through the cilium/ebpf library rather than through cgo.
+// SelectExecutor makes it available as an alternative to the existing
+// syscall-based executor; see SelectExecutor's doc comment for what still
+// needs to happen at the call site for that selection to take effect.
+type CiliumExecutor struct {
+	mu    sync.Mutex
+	progs map[int64]*ebpf.Program
+}
+
+// New returns a CiliumExecutor ready to validate and run programs.
+func New() *CiliumExecutor {
+	return &CiliumExecutor{progs: make(map[int64]*ebpf.Program)}
+}
+
+// ValidateProgram loads byteCode into the kernel verifier via cilium/ebpf
+// and reports whether it was accepted, returning the structured verifier
+// log the verifier produced either way.
+func (e *CiliumExecutor) ValidateProgram(byteCode []*fpb.Instruction) (*fpb.ValidationResult, error) {
+	spec := &ebpf.ProgramSpec{
+		Type:         ebpf.SocketFilter,
+		Instructions: toCiliumInstructions(byteCode),
+		License:      "GPL",
+		LogLevel:     ebpf.LogLevelInstruction | ebpf.LogLevelStats,
+		LogSize:      defaultLogSize,
+	}
+
+	prog, err := loadWithLogRetry(spec)
+	var log string
+	if prog != nil {
+		log = prog.VerifierLog
+	}
+	if err != nil {
+		// The verifier rejected the program; the log is still useful to
+		// the caller, so surface it alongside a not-valid result instead
+		// of propagating the load error.
+		var ve *ebpf.VerifierError
+		if errors.As(err, &ve) {
+			log = strings.Join(ve.Log, "\n")
+		}
+		return &fpb.ValidationResult{
+			IsValid:     false,
+			VerifierLog: log,
+		}, nil
+	}
+
+	// Keep the *ebpf.Program referenced by fd until the caller explicitly
+	// calls Cleanup: the proto only carries the raw fd across the
+	// strategies.ExecutorInterface boundary, and a finalizer here would
+	// race the caller still using that fd via RunProgram/Cleanup.
+	fd := int64(prog.FD())
+	e.mu.Lock()
+	e.progs[fd] = prog
+	e.mu.Unlock()
+
+	return &fpb.ValidationResult{
+		IsValid:     true,
+		ProgramFd:   fd,
+		VerifierLog: log,
+	}, nil
+}
+
+// RunProgram executes the program referenced by rpr and reports the
+// resulting log map contents, looking the program up by the fd recorded at
+// validation time and the map up by its fd.
+func (e *CiliumExecutor) RunProgram(rpr *fpb.RunProgramRequest) (*fpb.ExecutionResult, error) {
+	e.mu.Lock()
+	prog, ok := e.progs[rpr.GetProgFd()]
+	e.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no cilium program registered for fd %d", rpr.GetProgFd())
+	}
+
+	m, err := ebpf.NewMapFromFD(int(rpr.GetMapFd()))
+	if err != nil {
+		return nil, fmt.Errorf("could not reconstitute map from fd %d: %v", rpr.GetMapFd(), err)
+	}
+	defer m.Close()
+
+	ret, _, err := prog.Test(make([]byte, 14))
+	if err != nil {
+		return nil, fmt.Errorf("program execution failed: %v", err)
+	}
+
+	// A BPF_MAP_TYPE_PERCPU_ARRAY log map is read per CPU, and each index
+	// takes the first nonzero CPU value (zero if every CPU's value is
+	// zero). Any other map type is read as one int64 per index.
+	isPerCPU := m.Type() == ebpf.PerCPUArray
+	elements := make([]int64, rpr.GetMapCount())
+	for i := range elements {
+		if !isPerCPU {
+			if err := m.Lookup(uint32(i), &elements[i]); err != nil {
+				return nil, fmt.Errorf("could not read log map index %d: %v", i, err)
+			}
+			continue
+		}
+		var perCPU []int64
+		if err := m.Lookup(uint32(i), &perCPU); err != nil {
+			return nil, fmt.Errorf("could not read log map index %d: %v", i, err)
+		}
+		for _, v := range perCPU {
+			if v != 0 {
+				elements[i] = v
+				break
+			}
+		}
+	}
+
+	return &fpb.ExecutionResult{
+		DidSucceed: ret == 0,
+		Elements:   elements,
+	}, nil
+}
+
+// Cleanup releases the program referenced by progFD, removing it from this
+// executor's registry, and releases the map referenced by mapFD.
+func (e *CiliumExecutor) Cleanup(progFD, mapFD int64) {
+	e.mu.Lock()
+	prog, ok := e.progs[progFD]
+	delete(e.progs, progFD)
+	e.mu.Unlock()
+	if ok {
+		prog.Close()
+	}
+	// NewMapFromFD dups mapFD to build an independently-owned *ebpf.Map,
+	// so m.Close() only releases that dup; the original descriptor the
+	// caller handed us still has to be closed here.
+	if m, err := ebpf.NewMapFromFD(int(mapFD)); err == nil {
+		m.Close()
+	}
+	syscall.Close(int(mapFD))
+}
+
+// loadWithLogRetry loads spec, doubling LogSize and retrying when the
+// verifier log was truncated, up to maxLogSize.
+func loadWithLogRetry(spec *ebpf.ProgramSpec) (*ebpf.Program, error) {
+	for {
+		prog, err := ebpf.NewProgram(spec)
+		if err == nil {
+			return prog, nil
+		}
+		var ve *ebpf.VerifierError
+		if !errors.As(err, &ve) || !ve.Truncated || spec.LogSize >= maxLogSize {
+			return prog, err
+		}
+		spec.LogSize *= 2
+	}
+}
+
+// toCiliumInstructions converts the fuzzer's own instruction representation
+// into the asm.Instructions slice cilium/ebpf expects.
+func toCiliumInstructions(byteCode []*fpb.Instruction) asm.Instructions {
+	insns := make(asm.Instructions, 0, len(byteCode))
+	for _, inst := range byteCode {
+		insns = append(insns, asm.Instruction{
+			OpCode:   asm.OpCode(inst.GetOpcode()),
+			Dst:      asm.Register(inst.GetDst()),
+			Src:      asm.Register(inst.GetSrc()),
+			Offset:   int16(inst.GetOffset()),
+			Constant: int64(inst.GetImm()),
+		})
+	}
+	return insns
+}
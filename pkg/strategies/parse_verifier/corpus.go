@@ -0,0 +1,226 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseverifier
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	fpb "buzzer/proto/ebpf_fuzzer_go_proto"
+	"buzzer/pkg/strategies/parse_verifier/oracle/oracle"
+)
+
+// corpusEntry is a single accepted program together with the generator
+// state that produced it, so it can be reloaded and mutated further.
+type corpusEntry struct {
+	Gen      *Generator
+	ByteCode []*fpb.Instruction
+}
+
+// corpus is an on-disk, coverage-guided pool of accepted programs. New
+// entries are only kept when they exercise a (instruction-offset,
+// register, tnum-range-bucket) tuple that hasn't been seen before.
+type corpus struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int
+	entries []*corpusEntry
+	// paths holds the on-disk path for entries[i], in the same order, so
+	// an evicted in-memory entry's file can be removed too instead of
+	// being left behind as dead weight.
+	paths    []string
+	coverage map[string]bool
+	// nextID is a monotonic counter used to name persisted entries so
+	// that evicting the oldest entry (which pins len(entries) at
+	// maxSize) never causes two different entries to be written to the
+	// same path.
+	nextID int
+}
+
+// newCorpus creates a corpus backed by dir, loading any entries already
+// persisted there from a previous run.
+func newCorpus(dir string, maxSize int) (*corpus, error) {
+	c := &corpus{
+		dir:      dir,
+		maxSize:  maxSize,
+		coverage: make(map[string]bool),
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create corpus dir %q: %v", dir, err)
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads entries previously saved under c.dir back into memory. The
+// zero-padded filenames sort in write order, so once matches exceed
+// maxSize the oldest files on disk - not just the oldest in-memory
+// entries - are deleted, mirroring what considerAndAdd's eviction would
+// have done had the process never restarted.
+func (c *corpus) load() error {
+	matches, err := filepath.Glob(filepath.Join(c.dir, "*.gob"))
+	if err != nil {
+		return fmt.Errorf("could not list corpus dir %q: %v", c.dir, err)
+	}
+	sort.Strings(matches)
+
+	if c.maxSize > 0 && len(matches) > c.maxSize {
+		stale := matches[:len(matches)-c.maxSize]
+		for _, path := range stale {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("could not prune stale corpus entry %q: %v", path, err)
+			}
+		}
+		matches = matches[len(matches)-c.maxSize:]
+	}
+
+	for _, path := range matches {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not open corpus entry %q: %v", path, err)
+		}
+		var entry corpusEntry
+		err = gob.NewDecoder(f).Decode(&entry)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not decode corpus entry %q: %v", path, err)
+		}
+		c.entries = append(c.entries, &entry)
+		c.paths = append(c.paths, path)
+
+		base := strings.TrimSuffix(filepath.Base(path), ".gob")
+		if id, err := strconv.Atoi(base); err == nil && id > c.nextID {
+			c.nextID = id
+		}
+	}
+	return nil
+}
+
+// pickParent returns a random entry from the corpus to seed the next
+// mutation round, or nil if the corpus is still empty.
+func (c *corpus) pickParent() *corpusEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) == 0 {
+		return nil
+	}
+	return c.entries[rand.Intn(len(c.entries))]
+}
+
+// considerAndAdd records entry in the corpus, and persists it to disk, only
+// if at least one of tuples hasn't been observed before. It returns whether
+// the entry was kept.
+func (c *corpus) considerAndAdd(entry *corpusEntry, tuples []string) (bool, error) {
+	c.mu.Lock()
+	newTuple := false
+	for _, t := range tuples {
+		if !c.coverage[t] {
+			newTuple = true
+			c.coverage[t] = true
+		}
+	}
+	if !newTuple {
+		c.mu.Unlock()
+		return false, nil
+	}
+
+	c.nextID++
+	idx := c.nextID
+	path := ""
+	if c.dir != "" {
+		path = filepath.Join(c.dir, fmt.Sprintf("%08d.gob", idx))
+	}
+
+	c.entries = append(c.entries, entry)
+	c.paths = append(c.paths, path)
+	var evictedPath string
+	if c.maxSize > 0 && len(c.entries) > c.maxSize {
+		// Drop the oldest entry so the corpus doesn't grow without bound;
+		// the tuples it contributed stay marked as covered. Remember its
+		// path so the file backing it doesn't outlive the entry.
+		evictedPath = c.paths[0]
+		c.entries = c.entries[1:]
+		c.paths = c.paths[1:]
+	}
+	c.mu.Unlock()
+
+	if evictedPath != "" {
+		if err := os.Remove(evictedPath); err != nil && !os.IsNotExist(err) {
+			return true, fmt.Errorf("could not remove evicted corpus entry %q: %v", evictedPath, err)
+		}
+	}
+
+	if path == "" {
+		return true, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return true, fmt.Errorf("could not persist corpus entry %q: %v", path, err)
+	}
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(entry); err != nil {
+		return true, fmt.Errorf("could not encode corpus entry %q: %v", path, err)
+	}
+	return true, nil
+}
+
+// coverageTuples derives this run's coverage signal directly from the
+// oracle's own LookupRegValue, rather than a dedicated oracle-side
+// accessor: for every map index with a known verifier-predicted value, it
+// records an (offset, register, tnum-range-bucket) tuple. Runs that touch a
+// tuple no corpus entry has touched before are the ones worth keeping.
+func coverageTuples(gen *Generator, rpr *fpb.RunProgramRequest, regOracle *oracle.Oracle) ([]string, error) {
+	tuples := make([]string, 0, rpr.GetMapCount())
+	for mapIndex := int32(0); mapIndex < rpr.GetMapCount(); mapIndex++ {
+		offset := gen.GetProgramOffset(mapIndex)
+		dstReg := gen.GetDestReg(mapIndex)
+		value, known, err := regOracle.LookupRegValue(offset, dstReg)
+		if err != nil {
+			return nil, err
+		}
+		if !known {
+			continue
+		}
+		tuples = append(tuples, fmt.Sprintf("%d:%d:%d", offset, dstReg, tnumBucket(value)))
+	}
+	return tuples, nil
+}
+
+// tnumBucket coarsely log2-buckets a verifier-predicted value, so that
+// values that are "close" for the verifier's own tracking purposes count
+// as the same coverage tuple instead of each being treated as novel.
+func tnumBucket(v int64) int {
+	if v < 0 {
+		v = -v
+	}
+	bucket := 0
+	for v > 0 {
+		v >>= 1
+		bucket++
+	}
+	return bucket
+}
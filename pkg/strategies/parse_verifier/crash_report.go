@@ -0,0 +1,207 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseverifier
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	fpb "buzzer/proto/ebpf_fuzzer_go_proto"
+	"buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/strategies/parse_verifier/oracle/oracle"
+	"buzzer/pkg/strategies/strategies"
+)
+
+// mismatch describes a single verifier/runtime divergence found while
+// comparing the oracle's predicted register value against the value
+// actually observed at run time.
+type mismatch struct {
+	MapIndex      int32
+	Offset        int32
+	DstReg        uint8
+	VerifierValue int64
+	ActualValue   int64
+}
+
+// saveCrashReport writes a self-contained crash artifact directory for m
+// under dir, containing the raw bytecode, an annotated disassembly, the
+// full verifier log, the generator's persisted parameters, and a standalone
+// reproducer. mapCount tells the
+// reproducer how large a log map to create for itself, since m only
+// describes the divergence itself.
+func saveCrashReport(dir string, gr *strategies.GeneratorResult, gen *Generator, regOracle *oracle.Oracle, mapCount int32, m mismatch) (string, error) {
+	reportDir := filepath.Join(dir, fmt.Sprintf("crash-%d", time.Now().UnixNano()))
+	if err := os.MkdirAll(reportDir, 0o755); err != nil {
+		return "", fmt.Errorf("could not create crash report dir %q: %v", reportDir, err)
+	}
+
+	if err := writeBytecode(reportDir, gr.ProgByteCode); err != nil {
+		return "", err
+	}
+	if err := writeDisassembly(reportDir, gr.ProgByteCode, regOracle); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(reportDir, "verifier.log"), []byte(gr.VerifierLog), 0o644); err != nil {
+		return "", fmt.Errorf("could not write verifier log: %v", err)
+	}
+	if err := writeGeneratorState(reportDir, gen); err != nil {
+		return "", err
+	}
+	if err := writeReproducer(reportDir, gr.ProgByteCode, mapCount, m); err != nil {
+		return "", err
+	}
+
+	return reportDir, nil
+}
+
+// writeBytecode dumps the raw instruction stream, one instruction per line.
+func writeBytecode(dir string, byteCode []*fpb.Instruction) error {
+	f, err := os.Create(filepath.Join(dir, "bytecode.txt"))
+	if err != nil {
+		return fmt.Errorf("could not write bytecode: %v", err)
+	}
+	defer f.Close()
+	for i, inst := range byteCode {
+		fmt.Fprintf(f, "%04d: %s\n", i, inst.String())
+	}
+	return nil
+}
+
+// writeDisassembly dumps a disassembled listing in which each instruction
+// offset is annotated with the registers r0-r9 whose value the oracle's
+// LookupRegValue reports as known there, so a human triaging the crash can
+// see what the verifier believed those registers held. Registers without a
+// known value are left out; tnum masks, min/max ranges and the value
+// observed at run time are not printed.
+func writeDisassembly(dir string, byteCode []*fpb.Instruction, regOracle *oracle.Oracle) error {
+	f, err := os.Create(filepath.Join(dir, "disassembly.txt"))
+	if err != nil {
+		return fmt.Errorf("could not write disassembly: %v", err)
+	}
+	defer f.Close()
+
+	for offset, inst := range byteCode {
+		fmt.Fprintf(f, "%04d: %s", offset, inst.String())
+		for reg := uint8(ebpf.RegR0); reg <= uint8(ebpf.RegR9); reg++ {
+			if v, known, err := regOracle.LookupRegValue(int32(offset), reg); err == nil && known {
+				fmt.Fprintf(f, "  r%d=%d", reg, v)
+			}
+		}
+		fmt.Fprintln(f)
+	}
+	return nil
+}
+
+// writeGeneratorState persists the generator's parameters via gob: the
+// instruction count, log count and offset, size and register maps that
+// GobEncode records. No random seed is part of that state.
+func writeGeneratorState(dir string, gen *Generator) error {
+	f, err := os.Create(filepath.Join(dir, "generator.gob"))
+	if err != nil {
+		return fmt.Errorf("could not write generator state: %v", err)
+	}
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(gen); err != nil {
+		return fmt.Errorf("could not encode generator state: %v", err)
+	}
+	return nil
+}
+
+var reproducerTemplate = template.Must(template.New("reproducer").Parse(`// Code generated by buzzer's crash-report subsystem. DO NOT EDIT.
+//
+// This standalone reproducer loads and runs the exact bytecode that
+// produced a verifier/runtime mismatch at map index {{.MapIndex}}:
+// verifier predicted {{.VerifierValue}}, runtime observed {{.ActualValue}}.
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+
+	fpb "buzzer/proto/ebpf_fuzzer_go_proto"
+	ciliumexecutor "buzzer/pkg/executor/cilium_executor"
+)
+
+func main() {
+	byteCode := []*fpb.Instruction{
+{{range .ByteCode}}		&fpb.Instruction{Opcode: {{.GetOpcode}}, Dst: {{.GetDst}}, Src: {{.GetSrc}}, Offset: {{.GetOffset}}, Imm: {{.GetImm}}},
+{{end}}	}
+
+	// The original run's log map fd only meant something in the process
+	// that produced this crash report; a fresh process needs its own map
+	// of the same shape to run against.
+	logMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.PerCPUArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: {{.MapCount}},
+	})
+	if err != nil {
+		log.Fatalf("create log map: %v", err)
+	}
+	defer logMap.Close()
+
+	e := ciliumexecutor.New()
+	res, err := e.ValidateProgram(byteCode)
+	if err != nil {
+		log.Fatalf("validate program: %v", err)
+	}
+	if !res.GetIsValid() {
+		log.Fatalf("reproducer program was rejected by the verifier: %s", res.GetVerifierLog())
+	}
+
+	rpr := &fpb.RunProgramRequest{
+		ProgFd:      res.GetProgramFd(),
+		MapFd:       int64(logMap.FD()),
+		MapCount:    {{.MapCount}},
+		EbpfProgram: byteCode,
+	}
+	eR, err := e.RunProgram(rpr)
+	if err != nil {
+		log.Fatalf("run program: %v", err)
+	}
+	fmt.Printf("map index {{.MapIndex}} = %d (expected verifier value {{.VerifierValue}})\n", eR.GetElements()[{{.MapIndex}}])
+}
+`))
+
+// reproducerData is the template input for reproducerTemplate.
+type reproducerData struct {
+	mismatch
+	MapCount int32
+	ByteCode []*fpb.Instruction
+}
+
+// writeReproducer renders a standalone `go run`-able main package that
+// loads and runs just this program via the cilium/ebpf executor backend,
+// against a log map it creates for itself: the original run's map fd is
+// only meaningful inside the process that produced this crash report.
+func writeReproducer(dir string, byteCode []*fpb.Instruction, mapCount int32, m mismatch) error {
+	f, err := os.Create(filepath.Join(dir, "reproducer.go"))
+	if err != nil {
+		return fmt.Errorf("could not write reproducer: %v", err)
+	}
+	defer f.Close()
+	return reproducerTemplate.Execute(f, reproducerData{
+		mismatch: m,
+		MapCount: mapCount,
+		ByteCode: byteCode,
+	})
+}
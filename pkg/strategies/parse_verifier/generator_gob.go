@@ -0,0 +1,65 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseverifier
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// generatorState is a gob-encodable copy of the Generator fields the
+// corpus and crash-report subsystems need to persist and reload.
+// Generator's own fields are unexported, so gob refuses to walk it
+// directly ("type Generator has no exported fields"); GobEncode/
+// GobDecode below round-trip through this DTO instead.
+type generatorState struct {
+	InstructionCount int
+	LogCount         int32
+	OffsetMap        map[int32]int32
+	SizeMap          map[int32]int32
+	RegMap           map[int32]uint8
+}
+
+// GobEncode implements gob.GobEncoder, letting a *Generator be gob-encoded
+// wherever it's embedded - a corpus entry or a crash report - without
+// exporting its fields to the rest of the package.
+func (g *Generator) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	state := generatorState{
+		InstructionCount: g.instructionCount,
+		LogCount:         g.logCount,
+		OffsetMap:        g.offsetMap,
+		SizeMap:          g.sizeMap,
+		RegMap:           g.regMap,
+	}
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder, the inverse of GobEncode.
+func (g *Generator) GobDecode(data []byte) error {
+	var state generatorState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	g.instructionCount = state.InstructionCount
+	g.logCount = state.LogCount
+	g.offsetMap = state.OffsetMap
+	g.sizeMap = state.SizeMap
+	g.regMap = state.RegMap
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseverifier
+
+//#include <stdlib.h>
+//void close_fd(int fd);
+import "C"
+
+import (
+	fpb "buzzer/proto/ebpf_fuzzer_go_proto"
+	"buzzer/pkg/strategies/strategies"
+)
+
+// reproduces re-validates and re-runs byteCode through e, against the same
+// log map the original crash used, and reports whether it still reproduces
+// the same mismatch that was originally observed at m.MapIndex. It returns
+// false (rather than an error) for any byteCode that the verifier now
+// rejects or that otherwise fails to run, since that just means this
+// candidate isn't a valid reduction.
+func reproduces(e strategies.ExecutorInterface, byteCode []*fpb.Instruction, mapFd int64, mapCount int32, m mismatch) bool {
+	res, err := e.ValidateProgram(byteCode)
+	if err != nil || !res.GetIsValid() {
+		return false
+	}
+	defer C.close_fd(C.int(res.GetProgramFd()))
+
+	rpr := &fpb.RunProgramRequest{
+		ProgFd:      res.GetProgramFd(),
+		MapFd:       mapFd,
+		MapCount:    mapCount,
+		EbpfProgram: byteCode,
+	}
+	eR, err := e.RunProgram(rpr)
+	if err != nil || !eR.GetDidSucceed() {
+		return false
+	}
+	if int(m.MapIndex) >= len(eR.GetElements()) {
+		return false
+	}
+	return eR.GetElements()[m.MapIndex] == m.ActualValue
+}
+
+// minimize performs delta-debugging (ddmin) on byteCode, removing the
+// largest possible contiguous instruction ranges first and falling back to
+// per-instruction removal, while only keeping a reduction that still
+// reproduces m against e. This mirrors the test-case shrinking used by
+// go-fuzz/oss-fuzz. mapFd/mapCount identify the log map the original crash
+// was observed against.
+func minimize(e strategies.ExecutorInterface, byteCode []*fpb.Instruction, mapFd int64, mapCount int32, m mismatch) []*fpb.Instruction {
+	current := byteCode
+	chunkSize := len(current) / 2
+
+	for chunkSize > 0 {
+		reduced := false
+		for start := 0; start < len(current); start += chunkSize {
+			end := start + chunkSize
+			if end > len(current) {
+				end = len(current)
+			}
+			candidate := make([]*fpb.Instruction, 0, len(current)-(end-start))
+			candidate = append(candidate, current[:start]...)
+			candidate = append(candidate, current[end:]...)
+
+			if len(candidate) == 0 {
+				continue
+			}
+			if reproduces(e, candidate, mapFd, mapCount, m) {
+				current = candidate
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			if chunkSize == 1 {
+				break
+			}
+			chunkSize /= 2
+		}
+	}
+	return current
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseverifier
+
+import (
+	"math/rand"
+
+	"buzzer/pkg/ebpf/ebpf"
+)
+
+// mutators is the set of small, independent mutations applied to a clone
+// of a parent corpus entry's generator state to produce a new candidate,
+// mirroring the mutation set of a typical coverage-guided fuzzer like
+// libFuzzer/go-fuzz. Each mutator edits the generator's own fields rather
+// than a raw bytecode buffer, since ebpf.New(gen, ...) is the only
+// supported way to turn generator state back into a program and there is
+// no API to splice an edited instruction stream back in.
+var mutators = []func(gen *Generator){
+	mutateInstructionCount,
+	mutateRegister,
+	mutateOffset,
+	mutateSize,
+}
+
+// mutate clones parent.Gen and applies energy randomly chosen mutators to
+// the clone, returning a generator ready to be handed to ebpf.New. The
+// parent's own generator is never touched, so concurrent generator workers
+// can safely pick the same parent.
+func mutate(parent *corpusEntry, energy int) *Generator {
+	gen := cloneGenerator(parent.Gen)
+	for i := 0; i < energy; i++ {
+		mutators[rand.Intn(len(mutators))](gen)
+	}
+	return gen
+}
+
+// cloneGenerator returns a deep copy of g's maps, so mutating the result
+// can never corrupt the corpus entry g came from.
+func cloneGenerator(g *Generator) *Generator {
+	clone := &Generator{
+		instructionCount: g.instructionCount,
+		logCount:         g.logCount,
+		offsetMap:        make(map[int32]int32, len(g.offsetMap)),
+		sizeMap:          make(map[int32]int32, len(g.sizeMap)),
+		regMap:           make(map[int32]uint8, len(g.regMap)),
+	}
+	for k, v := range g.offsetMap {
+		clone.offsetMap[k] = v
+	}
+	for k, v := range g.sizeMap {
+		clone.sizeMap[k] = v
+	}
+	for k, v := range g.regMap {
+		clone.regMap[k] = v
+	}
+	return clone
+}
+
+// mutateInstructionCount nudges the number of instructions the generator
+// will emit by at most one (-1, 0 or +1), standing in for instruction
+// insert/delete.
+func mutateInstructionCount(gen *Generator) {
+	gen.instructionCount += rand.Intn(3) - 1
+	if gen.instructionCount < 1 {
+		gen.instructionCount = 1
+	}
+}
+
+// mutateRegister rewrites a random entry of regMap to another register
+// within [ebpf.RegR7, ebpf.RegR9], the same window the generator itself is
+// constrained to.
+func mutateRegister(gen *Generator) {
+	k, ok := randomRegMapKey(gen.regMap)
+	if !ok {
+		return
+	}
+	gen.regMap[k] = uint8(int(ebpf.RegR7) + rand.Intn(int(ebpf.RegR9-ebpf.RegR7)+1))
+}
+
+// mutateOffset nudges a random entry of offsetMap, so a later generation
+// round explores nearby tnum ranges the verifier hasn't exercised yet.
+func mutateOffset(gen *Generator) {
+	k, ok := randomOffsetMapKey(gen.offsetMap)
+	if !ok {
+		return
+	}
+	gen.offsetMap[k] += int32(rand.Intn(5) - 2)
+}
+
+// mutateSize nudges a random entry of sizeMap by a small delta.
+func mutateSize(gen *Generator) {
+	k, ok := randomOffsetMapKey(gen.sizeMap)
+	if !ok {
+		return
+	}
+	gen.sizeMap[k] += int32(rand.Intn(3) - 1)
+}
+
+// randomOffsetMapKey returns a random key from an int32-to-int32 map, and
+// whether the map had any entries to choose from.
+func randomOffsetMapKey(m map[int32]int32) (int32, bool) {
+	if len(m) == 0 {
+		return 0, false
+	}
+	keys := make([]int32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys[rand.Intn(len(keys))], true
+}
+
+// randomRegMapKey returns a random key from an int32-to-uint8 map, and
+// whether the map had any entries to choose from.
+func randomRegMapKey(m map[int32]uint8) (int32, bool) {
+	if len(m) == 0 {
+		return 0, false
+	}
+	keys := make([]int32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys[rand.Intn(len(keys))], true
+}
@@ -18,17 +18,10 @@
 // the registers will have vs the actual values that are observed at run time.
 package parseverifier
 
-//#include <stdlib.h>
-//void close_fd(int fd);
-import "C"
-
 import (
-	"errors"
+	"flag"
 	"fmt"
 
-	fpb "buzzer/proto/ebpf_fuzzer_go_proto"
-	"buzzer/pkg/ebpf/ebpf"
-	"buzzer/pkg/strategies/parse_verifier/oracle/oracle"
 	"buzzer/pkg/strategies/strategies"
 )
 
@@ -38,126 +31,53 @@ const (
 	StrategyName = "parse_verifier_log"
 )
 
+var (
+	corpusDir = flag.String("parse_verifier_corpus_dir", "",
+		"directory used to persist the coverage-guided corpus between runs; disabled if empty")
+	maxCorpusSize = flag.Int("parse_verifier_max_corpus_size", 10_000,
+		"maximum number of accepted programs kept in the corpus")
+	mutationEnergy = flag.Int("parse_verifier_mutation_energy", 4,
+		"number of mutations applied to a corpus parent to produce a new candidate")
+	crashDir = flag.String("parse_verifier_crash_dir", "/tmp/buzzer_crashes",
+		"directory where crash artifacts are written on a verifier/runtime mismatch")
+	minimizeCrashes = flag.Bool("minimize", false,
+		"whether to delta-debug a crashing program's instruction stream before saving its crash report")
+	jobs = flag.Int("jobs", 1,
+		"default worker count for each pipeline stage; overridden per-stage by the flags below")
+	generatorJobs = flag.Int("parse_verifier_generator_jobs", 0,
+		"number of generator workers; 0 means use --jobs")
+	loaderJobs = flag.Int("parse_verifier_loader_jobs", 0,
+		"number of loader workers validating candidates against the verifier; 0 means use --jobs")
+	executorJobs = flag.Int("parse_verifier_executor_jobs", 0,
+		"number of executor workers running accepted programs; 0 means use --jobs")
+)
+
+// stageJobs returns n if it was explicitly set, or --jobs otherwise.
+func stageJobs(n *int) int {
+	if *n > 0 {
+		return *n
+	}
+	return *jobs
+}
+
 // StrategyParseVerifierLog Implements a fuzzing strategy where the results of
 // the ebpf verifier will be parsed and then compared with the actual values
 // observed at run time.
 type StrategyParseVerifierLog struct{}
 
-func (st *StrategyParseVerifierLog) generateAndValidateProgram(e strategies.ExecutorInterface, gen *Generator) (*strategies.GeneratorResult, error) {
-	for i := 0; i < 100_000; i++ {
-		prog, err := ebpf.New(gen /*mapSize=*/, 1000 /*minReg=*/, ebpf.RegR7 /*maxReg=*/, ebpf.RegR9)
-		if err != nil {
-			return nil, err
-		}
-		byteCode := prog.GenerateBytecode()
-		res, err := e.ValidateProgram(byteCode)
-		if err != nil {
-			prog.Cleanup()
-			return nil, err
-		}
-
-		if res.GetIsValid() {
-			result := &strategies.GeneratorResult{
-				Prog:         prog,
-				ProgByteCode: byteCode,
-				ProgFD:       res.GetProgramFd(),
-				VerifierLog:  res.GetVerifierLog(),
-			}
-
-			return result, nil
-		}
-		prog.Cleanup()
-	}
-	return nil, errors.New("could not generate a valid program")
-}
-
-// Fuzz implements the main fuzzing logic.
+// Fuzz implements the main fuzzing logic. The heavy lifting - generating
+// candidates, validating them against the verifier, and running accepted
+// programs - happens concurrently across the worker pools set up in
+// runPipeline, since most of the wall clock in a single run is spent
+// blocked in the kernel rather than in this goroutine.
 func (st *StrategyParseVerifierLog) Fuzz(e strategies.ExecutorInterface) error {
-	fmt.Printf("running fuzzing strategy %s\n", StrategyName)
-	i := 0
-	for {
-		gen := &Generator{
-			instructionCount: 10,
-			offsetMap:        make(map[int32]int32),
-			sizeMap:          make(map[int32]int32),
-			regMap:           make(map[int32]uint8),
-		}
-		fmt.Printf("Fuzzer run no %d.                               \r", i)
-		i++
-		gr, err := st.generateAndValidateProgram(e, gen)
+	fmt.Printf("running fuzzing strategy %s with %d/%d/%d generator/loader/executor jobs\n",
+		StrategyName, stageJobs(generatorJobs), stageJobs(loaderJobs), stageJobs(executorJobs))
 
-		if err != nil {
-			return err
-		}
-
-		// Build a new execution request.
-		logMap := gr.Prog.LogMap()
-		logCount := gen.logCount
-		rpr := &fpb.RunProgramRequest {
-			ProgFd:      gr.ProgFD,
-			MapFd:       int64(logMap),
-			MapCount:    logCount,
-			EbpfProgram: gr.ProgByteCode,
-		}
-
-		defer func() {
-			C.close_fd(C.int(rpr.GetProgFd()))
-			C.close_fd(C.int(rpr.GetMapFd()))
-		}()
-
-		programFlaked := true
-
-		var exRes *fpb.ExecutionResult
-		maxAttempts := 1000
-
-		for programFlaked && maxAttempts != 0 {
-			maxAttempts--
-			eR, err := e.RunProgram(rpr)
-			if err != nil {
-				return err
-			}
-
-			if !eR.GetDidSucceed() {
-				return fmt.Errorf("execute Program did not succeed")
-			}
-			for i := 0; i < len(eR.GetElements()); i++ {
-				if eR.GetElements()[i] != 0 {
-					programFlaked = false
-					exRes = eR
-					break
-				}
-			}
-		}
-
-		if maxAttempts == 0 {
-			fmt.Println("program flaked")
-			strategies.SaveExecutionResults(gr)
-			continue
-		}
-
-		// Program succeeded, let's validate the execution map.
-		regOracle, err := oracle.FromVerifierTrace(gr.VerifierLog)
-		if err != nil {
-			return err
-		}
-
-		for mapIndex := int32(0); mapIndex < rpr.GetMapCount(); mapIndex++ {
-			offset := gen.GetProgramOffset(mapIndex)
-			dstReg := gen.GetDestReg(mapIndex)
-			verifierValue, known, err := regOracle.LookupRegValue(offset, dstReg)
-			if err != nil {
-				return err
-			}
-			actualValue := exRes.GetElements()[mapIndex]
-			if known && verifierValue != actualValue {
-				if err := strategies.SaveExecutionResults(gr); err != nil {
-					return err
-				}
-			}
-		}
-
-		C.close_fd(C.int(rpr.GetProgFd()))
-		C.close_fd(C.int(rpr.GetMapFd()))
+	cp, err := newCorpus(*corpusDir, *maxCorpusSize)
+	if err != nil {
+		return err
 	}
-	return nil
+
+	return st.runPipeline(e, cp)
 }
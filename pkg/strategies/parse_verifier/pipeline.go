@@ -0,0 +1,277 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseverifier
+
+//#include <stdlib.h>
+//void close_fd(int fd);
+import "C"
+
+import (
+	"fmt"
+	"sync"
+
+	fpb "buzzer/proto/ebpf_fuzzer_go_proto"
+	"buzzer/pkg/ebpf/ebpf"
+	"buzzer/pkg/strategies/parse_verifier/oracle/oracle"
+	"buzzer/pkg/strategies/strategies"
+)
+
+// candidate is a generated-but-not-yet-validated program, handed from a
+// generator worker to a loader worker.
+type candidate struct {
+	gen      *Generator
+	prog     *ebpf.Program
+	byteCode []*fpb.Instruction
+}
+
+// accepted is a program the verifier accepted, handed from a loader
+// worker to an executor worker.
+type accepted struct {
+	gen *Generator
+	gr  *strategies.GeneratorResult
+}
+
+// generateCandidate builds one candidate program, either mutated from a
+// corpus parent or generated from scratch, without validating it. This is
+// the producer side of the generator/loader/executor pipeline; validation
+// is left to the loader workers so the two stages can run concurrently.
+func (st *StrategyParseVerifierLog) generateCandidate(cp *corpus) (*candidate, error) {
+	var gen *Generator
+	if parent := cp.pickParent(); parent != nil {
+		// mutate clones parent.Gen, so the parent sitting in the corpus
+		// is never touched by this or any other generator worker.
+		gen = mutate(parent, *mutationEnergy)
+	} else {
+		gen = &Generator{
+			instructionCount: 10,
+			offsetMap:        make(map[int32]int32),
+			sizeMap:          make(map[int32]int32),
+			regMap:           make(map[int32]uint8),
+		}
+	}
+
+	prog, err := ebpf.New(gen /*mapSize=*/, 1000 /*minReg=*/, ebpf.RegR7 /*maxReg=*/, ebpf.RegR9)
+	if err != nil {
+		return nil, err
+	}
+
+	return &candidate{gen: gen, prog: prog, byteCode: prog.GenerateBytecode()}, nil
+}
+
+// runPipeline drives the N generator / M loader / K executor worker pools
+// that make up Fuzz, sharing a single corpus/coverage set across all of
+// them. The first error reported by any worker closes the shared done
+// channel, which stops every other worker from producing further work so
+// the pipeline actually tears down and returns that error, instead of the
+// unbounded generator/loader loops running forever around it.
+func (st *StrategyParseVerifierLog) runPipeline(e strategies.ExecutorInterface, cp *corpus) error {
+	candidates := make(chan *candidate, stageJobs(generatorJobs))
+	acceptedCh := make(chan *accepted, stageJobs(loaderJobs))
+
+	// done is closed the moment any worker reports an error, so every
+	// stage can stop producing instead of blocking forever on a channel
+	// send nobody downstream is still draining.
+	done := make(chan struct{})
+	errOnce := sync.Once{}
+	var firstErr error
+	reportErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+
+	var generators sync.WaitGroup
+	for i := 0; i < stageJobs(generatorJobs); i++ {
+		generators.Add(1)
+		go func() {
+			defer generators.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c, err := st.generateCandidate(cp)
+				if err != nil {
+					reportErr(err)
+					return
+				}
+				select {
+				case candidates <- c:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var loaders sync.WaitGroup
+	for i := 0; i < stageJobs(loaderJobs); i++ {
+		loaders.Add(1)
+		go func() {
+			defer loaders.Done()
+			for c := range candidates {
+				res, err := e.ValidateProgram(c.byteCode)
+				if err != nil {
+					c.prog.Cleanup()
+					reportErr(err)
+					return
+				}
+				if !res.GetIsValid() {
+					c.prog.Cleanup()
+					continue
+				}
+				select {
+				case acceptedCh <- &accepted{
+					gen: c.gen,
+					gr: &strategies.GeneratorResult{
+						Prog:         c.prog,
+						ProgByteCode: c.byteCode,
+						ProgFD:       res.GetProgramFd(),
+						VerifierLog:  res.GetVerifierLog(),
+					},
+				}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var executors sync.WaitGroup
+	for i := 0; i < stageJobs(executorJobs); i++ {
+		executors.Add(1)
+		go func() {
+			defer executors.Done()
+			for a := range acceptedCh {
+				if err := st.runOneExecution(e, cp, a.gen, a.gr); err != nil {
+					reportErr(err)
+				}
+			}
+		}()
+	}
+
+	// Tear the pipeline down stage by stage: once every generator has
+	// stopped (which only happens on error, since they loop forever
+	// otherwise), the candidates channel can close, which drains the
+	// loaders, which in turn lets the accepted channel close and drains
+	// the executors.
+	go func() {
+		generators.Wait()
+		close(candidates)
+	}()
+	go func() {
+		loaders.Wait()
+		close(acceptedCh)
+	}()
+
+	executors.Wait()
+	return firstErr
+}
+
+// runOneExecution runs a single accepted program, compares the verifier's
+// predicted register values against what actually happened at run time,
+// and feeds the corpus and crash-report subsystem accordingly. All cleanup
+// for this program's FDs happens before this function returns instead of
+// being deferred into the caller's loop, so long-running workers don't
+// accumulate deferred closures across iterations.
+func (st *StrategyParseVerifierLog) runOneExecution(e strategies.ExecutorInterface, cp *corpus, gen *Generator, gr *strategies.GeneratorResult) error {
+	logMap := gr.Prog.LogMap()
+	rpr := &fpb.RunProgramRequest{
+		ProgFd:      gr.ProgFD,
+		MapFd:       int64(logMap),
+		MapCount:    gen.logCount,
+		EbpfProgram: gr.ProgByteCode,
+	}
+	defer func() {
+		C.close_fd(C.int(rpr.GetProgFd()))
+		C.close_fd(C.int(rpr.GetMapFd()))
+	}()
+
+	eR, err := e.RunProgram(rpr)
+	if err != nil {
+		return err
+	}
+	if !eR.GetDidSucceed() {
+		return fmt.Errorf("execute Program did not succeed")
+	}
+
+	if !logMapPopulated(eR) {
+		if eR, err = e.RunProgram(rpr); err != nil {
+			return err
+		}
+		if !eR.GetDidSucceed() {
+			return fmt.Errorf("execute Program did not succeed")
+		}
+	}
+
+	if !logMapPopulated(eR) {
+		fmt.Println("log map came back empty after retry, treating this run as flaked")
+		return strategies.SaveExecutionResults(gr)
+	}
+
+	regOracle, err := oracle.FromVerifierTrace(gr.VerifierLog)
+	if err != nil {
+		return err
+	}
+
+	entry := &corpusEntry{Gen: gen, ByteCode: gr.ProgByteCode}
+	tuples, err := coverageTuples(gen, rpr, regOracle)
+	if err != nil {
+		return err
+	}
+	if _, err := cp.considerAndAdd(entry, tuples); err != nil {
+		return err
+	}
+
+	for mapIndex := int32(0); mapIndex < rpr.GetMapCount(); mapIndex++ {
+		offset := gen.GetProgramOffset(mapIndex)
+		dstReg := gen.GetDestReg(mapIndex)
+		verifierValue, known, err := regOracle.LookupRegValue(offset, dstReg)
+		if err != nil {
+			return err
+		}
+		actualValue := eR.GetElements()[mapIndex]
+		if !known || verifierValue == actualValue {
+			continue
+		}
+
+		if err := strategies.SaveExecutionResults(gr); err != nil {
+			return err
+		}
+
+		m := mismatch{
+			MapIndex:      mapIndex,
+			Offset:        offset,
+			DstReg:        dstReg,
+			VerifierValue: verifierValue,
+			ActualValue:   actualValue,
+		}
+		byteCode := gr.ProgByteCode
+		if *minimizeCrashes {
+			byteCode = minimize(e, byteCode, rpr.GetMapFd(), rpr.GetMapCount(), m)
+		}
+		minimizedGr := *gr
+		minimizedGr.ProgByteCode = byteCode
+		reportDir, err := saveCrashReport(*crashDir, &minimizedGr, gen, regOracle, rpr.GetMapCount(), m)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote crash report to %s\n", reportDir)
+	}
+
+	return nil
+}
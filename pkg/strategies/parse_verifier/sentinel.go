@@ -0,0 +1,32 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseverifier
+
+import fpb "buzzer/proto/ebpf_fuzzer_go_proto"
+
+// Telling "the program wrote zero" apart from "the slot was never
+// written" needs a generator-emitted sentinel tag and a switch of the log
+// map to BPF_MAP_TYPE_PERCPU_ARRAY, both of which live in pkg/ebpf and are
+// out of reach from this package. logMapPopulated is the same "any
+// element nonzero" flake heuristic the strategy has always used; it is
+// not a decode step for a tagging protocol that doesn't exist yet.
+func logMapPopulated(eR *fpb.ExecutionResult) bool {
+	for _, raw := range eR.GetElements() {
+		if raw != 0 {
+			return true
+		}
+	}
+	return false
+}